@@ -1,35 +1,98 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/cheggaaa/pb"
 	humanize "github.com/dustin/go-humanize"
 )
 
 var (
-	dir = flag.String("dir", "", "root to work from")
+	dir         = flag.String("dir", "", "root to work from")
+	forceRescan = flag.Bool("force-rescan", false, "ignore the persistent cache and rescan every package")
+	cachePath   = flag.String("cache-path", "", "path to the persistent scan cache (default ~/.cache/scrap-yard/usage.db)")
+	pruneCache  = flag.Bool("prune-cache", false, "drop cache entries whose package directories no longer exist, then exit")
+	workers     = flag.Int("workers", runtime.NumCPU(), "number of projects to scan concurrently")
+	throttle    = flag.Bool("throttle", false, "back off scanning when walk latency spikes above its moving baseline, to protect interactive disk latency")
+	format      = flag.String("format", "text", "output format: text, json, ndjson, or csv")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dedupe" {
+		if err := runDedupe(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 
+	path := resolveCachePath()
+
+	if *pruneCache {
+		if err := doPruneCache(path); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	validateFlagsOrExit()
 
-	if err := work(); err != nil {
+	if err := work(path); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// resolveCachePath returns the --cache-path override if given, otherwise
+// the default cache location under the user's home directory.
+func resolveCachePath() string {
+	if len(*cachePath) > 0 {
+		return *cachePath
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".cache", "scrap-yard", "usage.db")
+	}
+	return filepath.Join(home, ".cache", "scrap-yard", "usage.db")
+}
+
+func doPruneCache(path string) error {
+	cache, err := loadScanCache(path)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for pkgDir := range cache.Entries {
+		if _, err := os.Stat(pkgDir); os.IsNotExist(err) {
+			delete(cache.Entries, pkgDir)
+			removed++
+		}
+	}
+
+	fmt.Printf("pruned %d stale entries from %s\n", removed, path)
+	return saveScanCache(path, cache)
+}
+
 func validateFlagsOrExit() {
 	if len(*dir) == 0 {
 		fmt.Println("no directory given, exiting...")
@@ -37,12 +100,19 @@ func validateFlagsOrExit() {
 	}
 }
 
-func work() error {
-	root := *dir
+// scanAll walks every project under root looking for installed
+// node_modules trees, scanning them concurrently across a worker pool, and
+// returns the merged per-package results. It is shared by the default scan
+// report (work) and the dedupe subcommand (runDedupe).
+func scanAll(root, cachePath string) (*resultStore, error) {
+	cache, err := loadScanCache(cachePath)
+	if err != nil {
+		return nil, err
+	}
 
 	dirs, err := ioutil.ReadDir(root)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var projectsToCheck []os.FileInfo
@@ -55,49 +125,69 @@ func work() error {
 	fmt.Printf("found %d projects to check\n", len(projectsToCheck))
 
 	start := time.Now()
-	totalProcessed := 0
 
-	bar := pb.StartNew(len(projectsToCheck))
-	var data = make(map[string][]NodeUsageInfo)
-	for _, proj := range projectsToCheck {
-		projPath := filepath.Join(root, proj.Name())
+	numWorkers := *workers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
 
-		projFiles, err := ioutil.ReadDir(projPath)
-		if err != nil {
-			return err
-		}
+	store := newResultStore()
+	progress := newProgressCounter(len(projectsToCheck))
+	throttler := &ioThrottle{}
 
-		hasPkgJSON := false
-		hasNodeModules := false
-		for _, file := range projFiles {
-			if file.Name() == "package.json" {
-				hasPkgJSON = true
-			} else if file.Name() == "node_modules" {
-				hasNodeModules = true
-			}
-		}
-		if !hasPkgJSON || !hasNodeModules {
-			bar.Increment()
-			continue
-		}
+	jobs := make(chan os.FileInfo)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var workErr error
+	var totalProcessed int64
 
-		processed, err := traverseInstalledPkgs(data, filepath.Join(
-			projPath,
-			"node_modules",
-		))
-		if err != nil {
-			return err
-		}
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for proj := range jobs {
+				processed, err := processProject(root, proj, cache, store, throttler)
+				if err != nil {
+					errOnce.Do(func() { workErr = err })
+				} else {
+					atomic.AddInt64(&totalProcessed, int64(processed))
+				}
+				progress.increment()
+			}
+		}()
+	}
 
-		totalProcessed += processed
+	for _, proj := range projectsToCheck {
+		jobs <- proj
+	}
+	close(jobs)
+	wg.Wait()
+	progress.finish()
 
-		bar.Increment()
+	if workErr != nil {
+		return nil, workErr
 	}
-	bar.Finish()
+
 	fmt.Printf("processed %d entries in %s\n", totalProcessed, time.Now().Sub(start))
 
+	if err := saveScanCache(cachePath, cache); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func work(cachePath string) error {
+	store, err := scanAll(*dir, cachePath)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("formatting results...")
 
+	data := store.byID
+	hashGroups := store.byHash
+
 	var results = make([]OverallNodeUsage, len(data))
 	i := 0
 	for _, usage := range data {
@@ -112,11 +202,26 @@ func work() error {
 
 	sort.Sort(ByName(results))
 
+	switch *format {
+	case "json":
+		return emitJSON(*dir, results, store)
+	case "ndjson":
+		return emitNDJSON(results, store)
+	case "csv":
+		return emitCSV(results, store)
+	default:
+		return writeTextReport(results, hashGroups)
+	}
+}
+
+func writeTextReport(results []OverallNodeUsage, hashGroups map[string][]NodeUsageInfo) error {
 	f, err := os.Create("results.txt")
 	if err != nil {
 		return err
 	}
 
+	perRowHoistable := rowHashHoistable(hashGroups)
+
 	var globalUsage uint64
 	for _, pkgUsage := range results {
 		numInstances := len(pkgUsage.info)
@@ -124,24 +229,93 @@ func work() error {
 		pkgSizeHumanized := humanize.Bytes(pkgSize)
 		totalSize := uint64(numInstances) * pkgSize
 		totalSizeHumanized := humanize.Bytes(totalSize)
+		id := fmt.Sprintf("%s:%s", pkgUsage.pkgName, pkgUsage.pkgVersion)
 
 		f.WriteString(fmt.Sprintf(
-			"%s@%s: %d (%s -> %s)\n",
+			"%s@%s: %d (%s -> %s) hoistable: %s\n",
 			pkgUsage.pkgName,
 			pkgUsage.pkgVersion,
 			numInstances,
 			pkgSizeHumanized,
 			totalSizeHumanized,
+			humanize.Bytes(perRowHoistable[id]),
 		))
 
 		globalUsage += totalSize
 	}
+
+	sameName, aliased := hashGroupSavings(hashGroups)
+	f.WriteString(fmt.Sprintf(
+		"\nhoistable savings (same name@version, content verified): %s\n",
+		humanize.Bytes(sameName),
+	))
+	f.WriteString(fmt.Sprintf(
+		"hoistable savings (aliased/cross-name duplicates): %s\n",
+		humanize.Bytes(aliased),
+	))
 	f.Sync()
 
 	fmt.Printf("total space used: %s\n", humanize.Bytes(globalUsage))
+	fmt.Printf("total reclaimable via hoisting: %s\n", humanize.Bytes(sameName+aliased))
 	return f.Close()
 }
 
+// hashGroupSavings walks the content-hash groups and sums the bytes that
+// could be reclaimed by hoisting each group to a single shared copy,
+// per the request: (instances - 1) * size per hash group. Savings are only
+// ever counted within a hash group, so two installs of the same name@version
+// whose content actually differs (a corrupted install, a platform-specific
+// native addon, divergent postinstall output) are never reported as
+// hoistable. Groups are split into sameName (every instance shares a
+// package name) and aliased (the hashed content was installed under more
+// than one name) for reporting purposes; the two are mutually exclusive and
+// sum to the full hoistable total.
+func hashGroupSavings(hashGroups map[string][]NodeUsageInfo) (sameName uint64, aliased uint64) {
+	for _, group := range hashGroups {
+		if len(group) < 2 {
+			continue
+		}
+
+		names := make(map[string]bool)
+		for _, info := range group {
+			names[info.pkgName] = true
+		}
+
+		savings := uint64(len(group)-1) * uint64(group[0].dataSize)
+		if len(names) > 1 {
+			aliased += savings
+		} else {
+			sameName += savings
+		}
+	}
+	return sameName, aliased
+}
+
+// rowHashHoistable returns, per name:version id, the hash-verified hoistable
+// bytes for that row: instances are only counted as hoistable against other
+// instances that share the same content hash, never against the row's raw
+// instance count.
+func rowHashHoistable(hashGroups map[string][]NodeUsageInfo) map[string]uint64 {
+	perRow := make(map[string]uint64)
+	for _, group := range hashGroups {
+		if len(group) < 2 {
+			continue
+		}
+
+		byID := make(map[string]int)
+		for _, info := range group {
+			byID[fmt.Sprintf("%s:%s", info.pkgName, info.pkgVersion)]++
+		}
+
+		for id, count := range byID {
+			if count > 1 {
+				perRow[id] += uint64(count-1) * uint64(group[0].dataSize)
+			}
+		}
+	}
+	return perRow
+}
+
 type OverallNodeUsage struct {
 	pkgName    string
 	pkgVersion string
@@ -157,61 +331,1076 @@ func (a ByName) Less(i, j int) bool {
 	return strings.Compare(a[i].pkgName, a[j].pkgName) < 1
 }
 
-func traverseInstalledPkgs(data map[string][]NodeUsageInfo, proj string) (int, error) {
+func traverseInstalledPkgs(cache *scanCache, proj string) ([]NodeUsageInfo, int, error) {
 	pkgs, err := ioutil.ReadDir(proj)
 	if err != nil {
-		return -1, err
+		return nil, -1, err
 	}
 
+	var infos []NodeUsageInfo
 	for _, pkg := range pkgs {
 		if !pkg.IsDir() {
 			continue
 		}
 
-		raw, err := ioutil.ReadFile(filepath.Join(
-			proj,
-			pkg.Name(),
-			"package.json",
-		))
+		pkgDir := filepath.Join(proj, pkg.Name())
+		pkgJSONPath := filepath.Join(pkgDir, "package.json")
+
+		raw, err := ioutil.ReadFile(pkgJSONPath)
 		if os.IsNotExist(err) {
 			continue
 		} else if err != nil {
-			return -1, err
+			return nil, -1, err
 		}
 
 		var pkgInfo = make(map[string]interface{})
 		if err := json.Unmarshal(raw, &pkgInfo); err != nil {
-			return -1, err
+			return nil, -1, err
 		}
 
 		name := pkgInfo["name"].(string)
 		version := pkgInfo["version"].(string)
-		id := fmt.Sprintf("%s:%s", name, version)
 
-		dataSize, err := DirSize(filepath.Join(
-			proj,
-			pkg.Name(),
-		))
+		dataSize, hash, err := scanPackage(cache, pkgDir, pkgJSONPath)
 		if err != nil {
-			return -1, err
+			return nil, -1, err
+		}
+
+		infos = append(infos, NodeUsageInfo{
+			pkgName:     name,
+			pkgVersion:  version,
+			location:    proj,
+			pkgPath:     pkgDir,
+			dataSize:    dataSize,
+			contentHash: hash,
+		})
+	}
+	return infos, len(pkgs), nil
+}
+
+// processProject scans a single project directory for an installed
+// node_modules tree, merging any discovered packages into store. It is
+// safe to call concurrently from multiple workers over distinct projects.
+func processProject(root string, proj os.FileInfo, cache *scanCache, store *resultStore, throttler *ioThrottle) (int, error) {
+	projPath := filepath.Join(root, proj.Name())
+
+	projFiles, err := ioutil.ReadDir(projPath)
+	if err != nil {
+		return 0, err
+	}
+
+	hasPkgJSON := false
+	hasNodeModules := false
+	for _, file := range projFiles {
+		if file.Name() == "package.json" {
+			hasPkgJSON = true
+		} else if file.Name() == "node_modules" {
+			hasNodeModules = true
+		}
+	}
+	if !hasPkgJSON || !hasNodeModules {
+		return 0, nil
+	}
+
+	scanStart := time.Now()
+	infos, processed, err := traverseInstalledPkgs(cache, filepath.Join(projPath, "node_modules"))
+	throttler.observe(time.Now().Sub(scanStart))
+	if err != nil {
+		return 0, err
+	}
+
+	store.add(infos)
+
+	declared, err := parseLockfiles(projPath)
+	if err != nil {
+		return 0, err
+	}
+	store.addProject(crossReferenceLockfile(proj.Name(), projPath, infos, declared))
+	for _, info := range infos {
+		if declared[info.pkgName+"@"+info.pkgVersion] {
+			store.declare(fmt.Sprintf("%s:%s", info.pkgName, info.pkgVersion), proj.Name())
+		}
+	}
+
+	return processed, nil
+}
+
+// crossReferenceLockfile diffs a project's installed packages against its
+// lockfile's declared dependencies: installed packages missing from the
+// lockfile are candidates for `npm prune`, and lockfile entries with no
+// matching installed directory are missing on disk. declared is a set of
+// "name@version" ids rather than a name->version map, since a single
+// lockfile can legitimately declare the same package name at more than one
+// version (deduped transitive deps) and collapsing those onto one map key
+// would silently drop entries.
+func crossReferenceLockfile(name, path string, infos []NodeUsageInfo, declared map[string]bool) ProjectScan {
+	installed := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		installed[info.pkgName+"@"+info.pkgVersion] = true
+	}
+
+	var notInLockfile []string
+	for _, info := range infos {
+		id := info.pkgName + "@" + info.pkgVersion
+		if !declared[id] {
+			notInLockfile = append(notInLockfile, id)
+		}
+	}
+	sort.Strings(notInLockfile)
+
+	var missingFromDisk []string
+	for id := range declared {
+		if !installed[id] {
+			missingFromDisk = append(missingFromDisk, id)
 		}
+	}
+	sort.Strings(missingFromDisk)
+
+	return ProjectScan{
+		Name:            name,
+		Path:            path,
+		NotInLockfile:   notInLockfile,
+		MissingFromDisk: missingFromDisk,
+	}
+}
+
+// ProjectScan records a single project's lockfile cross-reference: installed
+// packages the lockfile doesn't declare, and declared packages missing from
+// disk.
+type ProjectScan struct {
+	Name            string
+	Path            string
+	NotInLockfile   []string
+	MissingFromDisk []string
+}
+
+// resultStore collects per-package scan results from concurrent workers,
+// keyed both by name:version and by content hash, plus per-project lockfile
+// cross-references and which projects declare each package. All access is
+// guarded by mu so workers can merge their findings as soon as each project
+// finishes.
+type resultStore struct {
+	mu         sync.Mutex
+	byID       map[string][]NodeUsageInfo
+	byHash     map[string][]NodeUsageInfo
+	projects   []ProjectScan
+	declaredBy map[string]map[string]bool
+}
+
+func newResultStore() *resultStore {
+	return &resultStore{
+		byID:       make(map[string][]NodeUsageInfo),
+		byHash:     make(map[string][]NodeUsageInfo),
+		declaredBy: make(map[string]map[string]bool),
+	}
+}
+
+func (s *resultStore) add(infos []NodeUsageInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, info := range infos {
+		id := fmt.Sprintf("%s:%s", info.pkgName, info.pkgVersion)
+		s.byID[id] = append(s.byID[id], info)
+		s.byHash[info.contentHash] = append(s.byHash[info.contentHash], info)
+	}
+}
+
+func (s *resultStore) addProject(ps ProjectScan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.projects = append(s.projects, ps)
+}
+
+func (s *resultStore) declare(id, projectName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.declaredBy[id] == nil {
+		s.declaredBy[id] = make(map[string]bool)
+	}
+	s.declaredBy[id][projectName] = true
+}
+
+// progressCounter is a thread-safe replacement for the old pb progress bar:
+// workers call increment() as each project finishes, in any order.
+type progressCounter struct {
+	mu    sync.Mutex
+	done  int64
+	total int64
+}
+
+func newProgressCounter(total int) *progressCounter {
+	return &progressCounter{total: int64(total)}
+}
+
+func (p *progressCounter) increment() {
+	done := atomic.AddInt64(&p.done, 1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Printf("\rprocessed %d/%d projects", done, p.total)
+}
+
+func (p *progressCounter) finish() {
+	fmt.Println()
+}
+
+// ioThrottle implements --throttle: it tracks a moving-average baseline of
+// how long a project's node_modules walk takes, and sleeps proportionally
+// when a walk comes in well above that baseline, on the assumption that the
+// disk is saturated and background scanning should yield to interactive
+// use. It is a no-op unless --throttle is passed.
+type ioThrottle struct {
+	mu       sync.Mutex
+	baseline time.Duration
+	primed   bool
+}
+
+func (t *ioThrottle) observe(elapsed time.Duration) {
+	if !*throttle {
+		return
+	}
 
-		nodeInfo := NodeUsageInfo{
-			pkgName:    name,
-			pkgVersion: version,
-			location:   proj,
-			dataSize:   dataSize,
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.primed {
+		t.baseline = elapsed
+		t.primed = true
+		return
+	}
+
+	t.baseline = time.Duration(0.9*float64(t.baseline) + 0.1*float64(elapsed))
+	if elapsed > 2*t.baseline {
+		time.Sleep(elapsed)
+	}
+}
+
+// scanPackage returns the data size and content hash for the package
+// directory at pkgDir, reusing the cached values from a prior run when the
+// directory's fingerprint hasn't changed. Pass --force-rescan to bypass the
+// cache entirely; either way the cache entry is refreshed before returning.
+func scanPackage(cache *scanCache, pkgDir, pkgJSONPath string) (int64, string, error) {
+	fp, err := fingerprintOf(pkgDir, pkgJSONPath)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if !*forceRescan {
+		if entry, ok := cache.get(pkgDir); ok && entry.Fingerprint.Equal(fp) {
+			return entry.DataSize, entry.ContentHash, nil
 		}
-		data[id] = append(data[id], nodeInfo)
 	}
-	return len(pkgs), nil
+
+	dataSize, err := DirSize(pkgDir)
+	if err != nil {
+		return -1, "", err
+	}
+
+	hash, err := contentHash(pkgDir)
+	if err != nil {
+		return -1, "", err
+	}
+
+	cache.set(pkgDir, cacheEntry{
+		Fingerprint: fp,
+		DataSize:    dataSize,
+		ContentHash: hash,
+	})
+	return dataSize, hash, nil
 }
 
 type NodeUsageInfo struct {
-	pkgName    string
-	pkgVersion string
-	location   string
-	dataSize   int64
+	pkgName     string
+	pkgVersion  string
+	location    string
+	pkgPath     string
+	dataSize    int64
+	contentHash string
+}
+
+// contentHash computes a stable content hash for an installed package
+// directory: a sha256 digest over a sorted manifest of (relpath, mode,
+// size, sha256(contents)) for every file beneath root. Nested
+// node_modules directories are skipped so that transitive dependency
+// trees are hashed independently rather than folded into their parent.
+func contentHash(root string) (string, error) {
+	var entries []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == "node_modules" && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(contents)
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, fmt.Sprintf(
+			"%s\t%s\t%d\t%s",
+			rel,
+			info.Mode(),
+			info.Size(),
+			hex.EncodeToString(sum[:]),
+		))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(entries)
+
+	manifest := sha256.New()
+	for _, entry := range entries {
+		manifest.Write([]byte(entry))
+		manifest.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(manifest.Sum(nil)), nil
+}
+
+// fingerprint identifies the on-disk state of an installed package well
+// enough to detect whether it needs rescanning: its own mtime/ctime plus
+// the size of its package.json (a cheap proxy for a version bump without
+// hashing the whole tree).
+type fingerprint struct {
+	ModTime     time.Time
+	CTime       time.Time
+	PkgJSONSize int64
+}
+
+// Equal compares fingerprints field-by-field by instant (UnixNano) instead
+// of ==: a fingerprint loaded back from the JSON cache file has its
+// time.Time values reparsed with a different *time.Location (and no
+// monotonic clock reading), so a struct == comparison against a
+// freshly-stat'd (Local) fingerprint would never match, permanently
+// defeating the cache across process runs.
+func (f fingerprint) Equal(other fingerprint) bool {
+	return f.ModTime.UnixNano() == other.ModTime.UnixNano() &&
+		f.CTime.UnixNano() == other.CTime.UnixNano() &&
+		f.PkgJSONSize == other.PkgJSONSize
+}
+
+func fingerprintOf(pkgDir, pkgJSONPath string) (fingerprint, error) {
+	dirInfo, err := os.Stat(pkgDir)
+	if err != nil {
+		return fingerprint{}, err
+	}
+
+	pkgJSONInfo, err := os.Stat(pkgJSONPath)
+	if err != nil {
+		return fingerprint{}, err
+	}
+
+	return fingerprint{
+		ModTime:     dirInfo.ModTime(),
+		CTime:       ctime(dirInfo),
+		PkgJSONSize: pkgJSONInfo.Size(),
+	}, nil
+}
+
+func ctime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
+}
+
+// cacheEntry is the persisted record for a single installed package
+// directory, keyed by its absolute path in scanCache.Entries.
+type cacheEntry struct {
+	Fingerprint fingerprint
+	DataSize    int64
+	ContentHash string
+}
+
+// scanCache is the on-disk, persistent form of previously computed package
+// scans, used to skip re-walking directories that haven't changed since the
+// last run. See --cache-path, --force-rescan and --prune-cache. mu guards
+// Entries since workers read and write it concurrently during a scan.
+type scanCache struct {
+	mu      sync.Mutex
+	Entries map[string]cacheEntry
+}
+
+func (c *scanCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.Entries[key]
+	return entry, ok
+}
+
+func (c *scanCache) set(key string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Entries[key] = entry
+}
+
+func loadScanCache(path string) (*scanCache, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &scanCache{Entries: make(map[string]cacheEntry)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cache scanCache
+	if err := json.Unmarshal(raw, &cache); err != nil {
+		return nil, err
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]cacheEntry)
+	}
+	return &cache, nil
+}
+
+func saveScanCache(path string, cache *scanCache) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, raw, 0644)
+}
+
+// dedupeAction is a single planned (or applied) replacement: the duplicate
+// at OriginalPath is removed and relinked to the canonical copy at
+// TargetPath.
+type dedupeAction struct {
+	OriginalPath string
+	TargetPath   string
+	Size         int64
+	ContentHash  string
+}
+
+// dedupeManifest is written before any filesystem mutation and is the only
+// thing --rollback needs to undo a dedupe run.
+type dedupeManifest struct {
+	CreatedAt time.Time
+	Symlink   bool
+	Actions   []dedupeAction
+}
+
+// runDedupe implements the `dedupe` subcommand: it plans a hardlink/symlink
+// replacement for every duplicated package tree found by scanAll, writes a
+// manifest, and - only when --apply is given together with --dry-run=false -
+// performs the replacement.
+func runDedupe(args []string) error {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dedupeDir := fs.String("dir", "", "root to scan for duplicate packages")
+	apply := fs.Bool("apply", false, "perform the dedupe instead of only printing the plan (requires --dry-run=false)")
+	dryRun := fs.Bool("dry-run", true, "print the plan and write the manifest without changing any package; pass --dry-run=false together with --apply to mutate")
+	useSymlink := fs.Bool("symlink", false, "replace duplicates with symlinks instead of hardlinks")
+	manifestOut := fs.String("manifest", "", "path to write the dedupe manifest (default dedupe-manifest-<unix-ts>.json)")
+	rollbackPath := fs.String("rollback", "", "undo a previous dedupe run by restoring copies from its manifest, then exit")
+	dedupeCachePath := fs.String("cache-path", "", "path to the persistent scan cache (default ~/.cache/scrap-yard/usage.db)")
+	fs.Parse(args)
+
+	if len(*rollbackPath) > 0 {
+		return rollbackDedupe(*rollbackPath)
+	}
+
+	if len(*dedupeDir) == 0 {
+		return fmt.Errorf("no directory given, pass --dir")
+	}
+
+	// Resolve to an absolute path before scanning: a symlink target is
+	// resolved relative to the link's own directory, not the process cwd,
+	// so pkgPath values derived from a relative --dir would produce
+	// broken symlinks under --symlink.
+	absDir, err := filepath.Abs(*dedupeDir)
+	if err != nil {
+		return err
+	}
+
+	cp := *dedupeCachePath
+	if len(cp) == 0 {
+		cp = resolveCachePath()
+	}
+
+	store, err := scanAll(absDir, cp)
+	if err != nil {
+		return err
+	}
+
+	actions, err := planDedupe(store.byHash, *useSymlink)
+	if err != nil {
+		return err
+	}
+
+	if len(actions) == 0 {
+		fmt.Println("no hoistable duplicates found")
+		return nil
+	}
+
+	manifestPath := *manifestOut
+	if len(manifestPath) == 0 {
+		manifestPath = fmt.Sprintf("dedupe-manifest-%d.json", time.Now().Unix())
+	}
+
+	manifest := dedupeManifest{CreatedAt: time.Now(), Symlink: *useSymlink, Actions: actions}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath, raw, 0644); err != nil {
+		return err
+	}
+
+	var totalReclaimed uint64
+	for _, action := range actions {
+		totalReclaimed += uint64(action.Size)
+		fmt.Printf("%s -> %s (%s)\n", action.OriginalPath, action.TargetPath, humanize.Bytes(uint64(action.Size)))
+	}
+	fmt.Printf("wrote manifest to %s\n", manifestPath)
+	fmt.Printf("planned reclaim: %s\n", humanize.Bytes(totalReclaimed))
+
+	if !*apply || *dryRun {
+		fmt.Println("dry run: no files were changed; rerun with --apply --dry-run=false to perform it")
+		return nil
+	}
+
+	for _, action := range actions {
+		if err := applyDedupeAction(action, *useSymlink); err != nil {
+			return err
+		}
+	}
+	fmt.Println("dedupe applied")
+	return nil
+}
+
+// planDedupe groups by content hash and, for every group with more than one
+// instance, picks the instance under the alphabetically first path as the
+// canonical copy and plans replacements for the rest. Groups are skipped
+// when any instance's bin entries have differing executable permissions.
+// When useSymlink is false (the hardlink path), candidates living on a
+// different filesystem than the canonical copy are also skipped, since
+// hardlinks can't cross devices; symlinks have no such restriction, so the
+// device check is skipped entirely when useSymlink is true.
+func planDedupe(hashGroups map[string][]NodeUsageInfo, useSymlink bool) ([]dedupeAction, error) {
+	var actions []dedupeAction
+	for hash, group := range hashGroups {
+		if len(group) < 2 {
+			continue
+		}
+
+		sorted := append([]NodeUsageInfo(nil), group...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].pkgPath < sorted[j].pkgPath })
+		canonical := sorted[0]
+
+		match, err := binPermsMatch(sorted)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+
+		var canonicalDev uint64
+		if !useSymlink {
+			canonicalDev, err = deviceOf(canonical.pkgPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, dup := range sorted[1:] {
+			if !useSymlink {
+				dupDev, err := deviceOf(dup.pkgPath)
+				if err != nil {
+					return nil, err
+				}
+				if dupDev != canonicalDev {
+					continue
+				}
+			}
+
+			actions = append(actions, dedupeAction{
+				OriginalPath: dup.pkgPath,
+				TargetPath:   canonical.pkgPath,
+				Size:         dup.dataSize,
+				ContentHash:  hash,
+			})
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].OriginalPath < actions[j].OriginalPath })
+	return actions, nil
+}
+
+// binPermsMatch reports whether every instance in group declares the same
+// executable permissions for its package.json "bin" entries. Packages whose
+// bin scripts differ in mode between copies are not safe to collapse onto a
+// single canonical copy.
+func binPermsMatch(group []NodeUsageInfo) (bool, error) {
+	var reference map[string]os.FileMode
+	for i, info := range group {
+		raw, err := ioutil.ReadFile(filepath.Join(info.pkgPath, "package.json"))
+		if err != nil {
+			return false, err
+		}
+
+		var pkgInfo map[string]interface{}
+		if err := json.Unmarshal(raw, &pkgInfo); err != nil {
+			return false, err
+		}
+
+		perms := make(map[string]os.FileMode)
+		for name, rel := range binEntries(pkgInfo["bin"]) {
+			fi, err := os.Stat(filepath.Join(info.pkgPath, rel))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			perms[name] = fi.Mode().Perm()
+		}
+
+		if i == 0 {
+			reference = perms
+			continue
+		}
+		if !permsEqual(reference, perms) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// binEntries normalizes package.json's "bin" field, which npm allows to be
+// either a single string (one script named after the package) or a map of
+// command name to script path.
+func binEntries(raw interface{}) map[string]string {
+	entries := make(map[string]string)
+	switch v := raw.(type) {
+	case string:
+		entries["default"] = v
+	case map[string]interface{}:
+		for name, target := range v {
+			if s, ok := target.(string); ok {
+				entries[name] = s
+			}
+		}
+	}
+	return entries
+}
+
+func permsEqual(a, b map[string]os.FileMode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, mode := range a {
+		if other, ok := b[name]; !ok || other != mode {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceOf returns the filesystem device ID backing path, used to refuse
+// hardlinking across filesystem boundaries.
+func deviceOf(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot determine device for %s", path)
+	}
+	return uint64(stat.Dev), nil
+}
+
+func applyDedupeAction(action dedupeAction, useSymlink bool) error {
+	if useSymlink {
+		if err := os.RemoveAll(action.OriginalPath); err != nil {
+			return err
+		}
+		return os.Symlink(action.TargetPath, action.OriginalPath)
+	}
+	return relinkFiles(action.TargetPath, action.OriginalPath)
+}
+
+// relinkFiles replaces every file under original with a hardlink to the
+// matching file under target, since a whole directory tree can't be
+// hardlinked in one call the way it can be symlinked.
+func relinkFiles(target, original string) error {
+	return filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(target, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(original, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(dst, info.Mode())
+		}
+
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(path, dst)
+	})
+}
+
+// rollbackDedupe undoes a previous dedupe run from its manifest, restoring
+// each original path as an independent copy of its canonical target.
+func rollbackDedupe(manifestPath string) error {
+	raw, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var manifest dedupeManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return err
+	}
+
+	for _, action := range manifest.Actions {
+		if err := os.RemoveAll(action.OriginalPath); err != nil {
+			return err
+		}
+		if err := copyDir(action.TargetPath, action.OriginalPath); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("restored %d packages from %s\n", len(manifest.Actions), manifestPath)
+	return nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, contents, info.Mode())
+	})
+}
+
+// parseLockfiles returns the set of "name@version" ids declared by a
+// project's lockfile. A set keyed by the composite id is used instead of a
+// name->version map because a single lockfile can legitimately declare the
+// same package name at more than one version (deduped transitive deps); a
+// plain map[string]string would collapse those onto one entry depending on
+// Go's randomized map iteration order, silently dropping versions from run
+// to run.
+func parseLockfiles(projPath string) (map[string]bool, error) {
+	if deps, ok, err := parsePackageLockJSON(filepath.Join(projPath, "package-lock.json")); err != nil {
+		return nil, err
+	} else if ok {
+		return deps, nil
+	}
+
+	if deps, ok, err := parseYarnLock(filepath.Join(projPath, "yarn.lock")); err != nil {
+		return nil, err
+	} else if ok {
+		return deps, nil
+	}
+
+	if deps, ok, err := parsePnpmLock(filepath.Join(projPath, "pnpm-lock.yaml")); err != nil {
+		return nil, err
+	} else if ok {
+		return deps, nil
+	}
+
+	return map[string]bool{}, nil
+}
+
+func parsePackageLockJSON(path string) (map[string]bool, bool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, false, err
+	}
+
+	deps := make(map[string]bool)
+	if top, ok := doc["dependencies"].(map[string]interface{}); ok {
+		collectLockDeps(top, deps)
+	}
+	return deps, true, nil
+}
+
+// collectLockDeps walks npm's (lockfileVersion 1/2) nested "dependencies"
+// tree and flattens it into a set of "name@version" ids, recursing into
+// each entry's own nested dependencies.
+func collectLockDeps(deps map[string]interface{}, out map[string]bool) {
+	for name, raw := range deps {
+		entry, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if v, ok := entry["version"].(string); ok {
+			out[name+"@"+v] = true
+		}
+		if nested, ok := entry["dependencies"].(map[string]interface{}); ok {
+			collectLockDeps(nested, out)
+		}
+	}
+}
+
+// parseYarnLock extracts "name@version" ids from a yarn.lock. Each entry is
+// a comma-separated list of quoted "name@range" headers followed by an
+// indented `version "x.y.z"` line; every name on the header resolves to that
+// version.
+func parseYarnLock(path string) (map[string]bool, bool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	deps := make(map[string]bool)
+	var pending []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		switch {
+		case len(line) == 0 || line[0] == '#':
+			continue
+		case !strings.HasPrefix(line, " ") && strings.HasSuffix(strings.TrimSpace(line), ":"):
+			header := strings.TrimSuffix(strings.TrimSpace(line), ":")
+			pending = pending[:0]
+			for _, spec := range strings.Split(header, ", ") {
+				spec = strings.Trim(spec, "\"")
+				if idx := strings.LastIndex(spec, "@"); idx > 0 {
+					pending = append(pending, spec[:idx])
+				}
+			}
+		case strings.HasPrefix(strings.TrimSpace(line), "version "):
+			version := strings.Trim(strings.TrimPrefix(strings.TrimSpace(line), "version "), "\"")
+			for _, name := range pending {
+				deps[name+"@"+version] = true
+			}
+			pending = nil
+		}
+	}
+	return deps, true, nil
+}
+
+// parsePnpmLock extracts "name@version" ids from the top-level
+// "dependencies:" and "devDependencies:" blocks of a pnpm-lock.yaml, handling both the compact
+// `name: version` form and the expanded `name:` / `  version: ...` form
+// used by pnpm v6+. It does not attempt to parse the full lockfile schema.
+func parsePnpmLock(path string) (map[string]bool, bool, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	deps := make(map[string]bool)
+	inDeps := false
+	currentName := ""
+	for _, line := range strings.Split(string(raw), "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if indent == 0 {
+			inDeps = trimmed == "dependencies:" || trimmed == "devDependencies:"
+			currentName = ""
+			continue
+		}
+		if !inDeps || trimmed == "" {
+			continue
+		}
+
+		switch indent {
+		case 2:
+			parts := strings.SplitN(trimmed, ":", 2)
+			name := strings.Trim(parts[0], "\"")
+			if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+				deps[name+"@"+strings.Trim(strings.TrimSpace(parts[1]), "\"")] = true
+				currentName = ""
+			} else {
+				currentName = name
+			}
+		case 4:
+			if currentName != "" && strings.HasPrefix(trimmed, "version:") {
+				version := strings.Trim(strings.TrimSpace(strings.TrimPrefix(trimmed, "version:")), "\"")
+				deps[currentName+"@"+version] = true
+			}
+		}
+	}
+	return deps, true, nil
+}
+
+// jsonPackageRecord is one entry in the `packages` array of the json/ndjson
+// output formats.
+type jsonPackageRecord struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Size        int64    `json:"size"`
+	Instances   int      `json:"instances"`
+	Locations   []string `json:"locations"`
+	ContentHash string   `json:"content_hash"`
+	DeclaredBy  []string `json:"declared_by"`
+}
+
+type jsonProjectRecord struct {
+	Name            string   `json:"name"`
+	Path            string   `json:"path"`
+	NotInLockfile   []string `json:"not_in_lockfile,omitempty"`
+	MissingFromDisk []string `json:"missing_from_disk,omitempty"`
+}
+
+type jsonTotals struct {
+	TotalSize        uint64 `json:"total_size"`
+	HoistableSavings uint64 `json:"hoistable_savings"`
+}
+
+type jsonReport struct {
+	ScannedAt time.Time           `json:"scanned_at"`
+	Root      string              `json:"root"`
+	Projects  []jsonProjectRecord `json:"projects"`
+	Packages  []jsonPackageRecord `json:"packages"`
+	Totals    jsonTotals          `json:"totals"`
+}
+
+func buildPackageRecords(results []OverallNodeUsage, store *resultStore) []jsonPackageRecord {
+	records := make([]jsonPackageRecord, 0, len(results))
+	for _, r := range results {
+		id := fmt.Sprintf("%s:%s", r.pkgName, r.pkgVersion)
+
+		locations := make([]string, 0, len(r.info))
+		for _, info := range r.info {
+			locations = append(locations, info.pkgPath)
+		}
+
+		var declaredBy []string
+		for name := range store.declaredBy[id] {
+			declaredBy = append(declaredBy, name)
+		}
+		sort.Strings(declaredBy)
+
+		records = append(records, jsonPackageRecord{
+			Name:        r.pkgName,
+			Version:     r.pkgVersion,
+			Size:        r.size,
+			Instances:   len(r.info),
+			Locations:   locations,
+			ContentHash: r.info[0].contentHash,
+			DeclaredBy:  declaredBy,
+		})
+	}
+	return records
+}
+
+func buildProjectRecords(store *resultStore) []jsonProjectRecord {
+	records := make([]jsonProjectRecord, 0, len(store.projects))
+	for _, p := range store.projects {
+		records = append(records, jsonProjectRecord{
+			Name:            p.Name,
+			Path:            p.Path,
+			NotInLockfile:   p.NotInLockfile,
+			MissingFromDisk: p.MissingFromDisk,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+func emitJSON(root string, results []OverallNodeUsage, store *resultStore) error {
+	var totalSize uint64
+	for _, r := range results {
+		totalSize += uint64(len(r.info)) * uint64(r.size)
+	}
+
+	sameName, aliased := hashGroupSavings(store.byHash)
+
+	report := jsonReport{
+		ScannedAt: time.Now(),
+		Root:      root,
+		Projects:  buildProjectRecords(store),
+		Packages:  buildPackageRecords(results, store),
+		Totals: jsonTotals{
+			TotalSize:        totalSize,
+			HoistableSavings: sameName + aliased,
+		},
+	}
+
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(raw))
+	return nil
+}
+
+func emitNDJSON(results []OverallNodeUsage, store *resultStore) error {
+	enc := json.NewEncoder(os.Stdout)
+	for _, record := range buildPackageRecords(results, store) {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func emitCSV(results []OverallNodeUsage, store *resultStore) error {
+	w := csv.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if err := w.Write([]string{"name", "version", "size", "instances", "content_hash", "declared_by", "locations"}); err != nil {
+		return err
+	}
+
+	for _, record := range buildPackageRecords(results, store) {
+		if err := w.Write([]string{
+			record.Name,
+			record.Version,
+			strconv.FormatInt(record.Size, 10),
+			strconv.Itoa(record.Instances),
+			record.ContentHash,
+			strings.Join(record.DeclaredBy, ";"),
+			strings.Join(record.Locations, ";"),
+		}); err != nil {
+			return err
+		}
+	}
+	return w.Error()
 }
 
 func DirSize(path string) (int64, error) {
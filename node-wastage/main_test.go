@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestPkg creates a minimal installed-package directory at dir, with a
+// package.json and, when bin is non-empty, a "bin" entry naming a script
+// written with mode dataMode, for exercising planDedupe/applyDedupeAction
+// without a full scanAll.
+func writeTestPkg(t *testing.T, dir, bin string, dataMode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgJSON := map[string]interface{}{"name": filepath.Base(dir), "version": "1.0.0"}
+	if bin != "" {
+		pkgJSON["bin"] = bin
+		if err := ioutil.WriteFile(filepath.Join(dir, bin), []byte("#!/usr/bin/env node\n"), dataMode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw, err := json.Marshal(pkgJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "package.json"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFingerprintEqualAcrossJSONRoundTrip(t *testing.T) {
+	fp := fingerprint{
+		ModTime:     time.Now(),
+		CTime:       time.Now(),
+		PkgJSONSize: 42,
+	}
+
+	raw, err := json.Marshal(fp)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var reloaded fingerprint
+	if err := json.Unmarshal(raw, &reloaded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if fp == reloaded {
+		t.Skip("runtime no longer reparses JSON times in UTC; struct equality already holds")
+	}
+	if !fp.Equal(reloaded) {
+		t.Fatalf("fingerprint.Equal should treat a JSON round trip as unchanged: %+v vs %+v", fp, reloaded)
+	}
+}
+
+func TestScanCacheHitsAcrossProcessRuns(t *testing.T) {
+	root := t.TempDir()
+	pkgDir := root + "/pkg"
+	if err := os.MkdirAll(pkgDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pkgJSON := pkgDir + "/package.json"
+	if err := ioutil.WriteFile(pkgJSON, []byte(`{"name":"x","version":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cachePath := root + "/cache.db"
+
+	cache, err := loadScanCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := scanPackage(cache, pkgDir, pkgJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveScanCache(cachePath, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadScanCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := fingerprintOf(pkgDir, pkgJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := reloaded.get(pkgDir)
+	if !ok {
+		t.Fatalf("expected a cache entry for %s", pkgDir)
+	}
+	if !entry.Fingerprint.Equal(fp) {
+		t.Fatalf("cache entry loaded from disk should match a freshly computed fingerprint: %+v vs %+v", entry.Fingerprint, fp)
+	}
+}
+
+func TestHashGroupSavingsRequiresMatchingContentHash(t *testing.T) {
+	hashGroups := map[string][]NodeUsageInfo{
+		// Two installs of the same name@version, but divergent content
+		// (e.g. a corrupted install): must not be reported as hoistable.
+		"hash-divergent-a": {
+			{pkgName: "left-pad", pkgVersion: "1.0.0", dataSize: 100, contentHash: "hash-divergent-a"},
+		},
+		"hash-divergent-b": {
+			{pkgName: "left-pad", pkgVersion: "1.0.0", dataSize: 100, contentHash: "hash-divergent-b"},
+		},
+		// Two installs of the same name@version that are byte-identical:
+		// hoistable as sameName.
+		"hash-shared": {
+			{pkgName: "is-odd", pkgVersion: "2.0.0", dataSize: 50, contentHash: "hash-shared"},
+			{pkgName: "is-odd", pkgVersion: "2.0.0", dataSize: 50, contentHash: "hash-shared"},
+		},
+		// Same content installed under two different names: hoistable as
+		// aliased, not sameName.
+		"hash-aliased": {
+			{pkgName: "lodash", pkgVersion: "4.0.0", dataSize: 200, contentHash: "hash-aliased"},
+			{pkgName: "lodash.clone", pkgVersion: "4.0.0", dataSize: 200, contentHash: "hash-aliased"},
+		},
+	}
+
+	sameName, aliased := hashGroupSavings(hashGroups)
+	if sameName != 50 {
+		t.Fatalf("sameName = %d, want 50 (divergent-hash duplicates must not count)", sameName)
+	}
+	if aliased != 200 {
+		t.Fatalf("aliased = %d, want 200", aliased)
+	}
+
+	perRow := rowHashHoistable(hashGroups)
+	if got := perRow["left-pad:1.0.0"]; got != 0 {
+		t.Fatalf("left-pad:1.0.0 hoistable = %d, want 0 (same name@version, different content hash)", got)
+	}
+	if got := perRow["is-odd:2.0.0"]; got != 50 {
+		t.Fatalf("is-odd:2.0.0 hoistable = %d, want 50", got)
+	}
+}
+
+func TestCollectLockDepsKeepsMultipleVersionsOfSameName(t *testing.T) {
+	deps := map[string]interface{}{
+		"lodash": map[string]interface{}{
+			"version": "4.17.21",
+			"dependencies": map[string]interface{}{
+				"lodash": map[string]interface{}{
+					"version": "3.10.1",
+				},
+			},
+		},
+	}
+
+	out := make(map[string]bool)
+	collectLockDeps(deps, out)
+
+	if !out["lodash@4.17.21"] {
+		t.Fatalf("expected lodash@4.17.21 to survive, got %v", out)
+	}
+	if !out["lodash@3.10.1"] {
+		t.Fatalf("expected nested lodash@3.10.1 to survive alongside the top-level version, got %v", out)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected both versions to be kept, got %v", out)
+	}
+}
+
+func TestParseYarnLockKeepsMultipleVersionsOfSameName(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/yarn.lock"
+	contents := `# THIS IS AN AUTOGENERATED FILE
+"is-odd@^2.0.0":
+  version "2.0.0"
+
+"is-odd@^3.0.0":
+  version "3.0.1"
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deps, ok, err := parseYarnLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected parseYarnLock to report the file as present")
+	}
+	if !deps["is-odd@2.0.0"] || !deps["is-odd@3.0.1"] {
+		t.Fatalf("expected both is-odd versions to be kept, got %v", deps)
+	}
+}
+
+func TestParsePnpmLockReadsExpandedVersionEntries(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/pnpm-lock.yaml"
+	contents := `dependencies:
+  is-odd:
+    version: 2.0.0
+  is-odd2:
+    version: 3.0.1
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deps, ok, err := parsePnpmLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected parsePnpmLock to report the file as present")
+	}
+	if !deps["is-odd@2.0.0"] || !deps["is-odd2@3.0.1"] {
+		t.Fatalf("expected both packages' versions to be kept, got %v", deps)
+	}
+}
+
+func TestPlanDedupePicksAlphabeticallyFirstCanonical(t *testing.T) {
+	root := t.TempDir()
+	bPath := filepath.Join(root, "b-pkg")
+	aPath := filepath.Join(root, "a-pkg")
+	writeTestPkg(t, bPath, "", 0)
+	writeTestPkg(t, aPath, "", 0)
+
+	hashGroups := map[string][]NodeUsageInfo{
+		"shared-hash": {
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: bPath, dataSize: 10, contentHash: "shared-hash"},
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: aPath, dataSize: 10, contentHash: "shared-hash"},
+		},
+	}
+
+	actions, err := planDedupe(hashGroups, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 {
+		t.Fatalf("expected exactly 1 action, got %d: %+v", len(actions), actions)
+	}
+	if actions[0].TargetPath != aPath {
+		t.Fatalf("expected canonical (target) to be the alphabetically first path %s, got %s", aPath, actions[0].TargetPath)
+	}
+	if actions[0].OriginalPath != bPath {
+		t.Fatalf("expected the duplicate (original) to be %s, got %s", bPath, actions[0].OriginalPath)
+	}
+}
+
+func TestPlanDedupeSkipsOnBinPermissionMismatch(t *testing.T) {
+	root := t.TempDir()
+	aPath := filepath.Join(root, "a-pkg")
+	bPath := filepath.Join(root, "b-pkg")
+	writeTestPkg(t, aPath, "bin.js", 0755)
+	writeTestPkg(t, bPath, "bin.js", 0644)
+
+	hashGroups := map[string][]NodeUsageInfo{
+		"shared-hash": {
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: aPath, dataSize: 10, contentHash: "shared-hash"},
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: bPath, dataSize: 10, contentHash: "shared-hash"},
+		},
+	}
+
+	actions, err := planDedupe(hashGroups, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 0 {
+		t.Fatalf("expected diverging bin permissions to skip the group, got %+v", actions)
+	}
+}
+
+// TestPlanDedupeCrossDeviceOnlySkippedForHardlinks mounts a tmpfs so one
+// instance of a duplicate group lives on a different device than the
+// canonical copy. Hardlinks can't cross devices, so useSymlink=false must
+// skip the pair; symlinks have no such restriction, so useSymlink=true must
+// plan it. Requires CAP_SYS_ADMIN to mount; skips if unavailable.
+func TestPlanDedupeCrossDeviceOnlySkippedForHardlinks(t *testing.T) {
+	mountPoint := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "tmpfs", "-o", "size=10m", "tmpfs", mountPoint).CombinedOutput(); err != nil {
+		t.Skipf("cannot mount tmpfs in this sandbox, skipping: %v: %s", err, out)
+	}
+	defer exec.Command("umount", mountPoint).Run()
+
+	root := t.TempDir()
+	canonical := filepath.Join(root, "a-pkg")
+	dup := filepath.Join(mountPoint, "b-pkg")
+	writeTestPkg(t, canonical, "", 0)
+	writeTestPkg(t, dup, "", 0)
+
+	canonicalDev, err := deviceOf(canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupDev, err := deviceOf(dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonicalDev == dupDev {
+		t.Skip("tmpfs mount did not produce a distinct device in this sandbox, skipping")
+	}
+
+	hashGroups := map[string][]NodeUsageInfo{
+		"shared-hash": {
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: canonical, dataSize: 10, contentHash: "shared-hash"},
+			{pkgName: "x", pkgVersion: "1.0.0", pkgPath: dup, dataSize: 10, contentHash: "shared-hash"},
+		},
+	}
+
+	hardlinkActions, err := planDedupe(hashGroups, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hardlinkActions) != 0 {
+		t.Fatalf("expected cross-device pair to be skipped when hardlinking, got %+v", hardlinkActions)
+	}
+
+	symlinkActions, err := planDedupe(hashGroups, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symlinkActions) != 1 {
+		t.Fatalf("expected cross-device pair to still be planned when symlinking, got %+v", symlinkActions)
+	}
+}
+
+func TestApplyDedupeActionHardlinksDuplicateToCanonical(t *testing.T) {
+	root := t.TempDir()
+	canonical := filepath.Join(root, "canonical")
+	dup := filepath.Join(root, "dup")
+	writeTestPkg(t, canonical, "", 0)
+	writeTestPkg(t, dup, "", 0)
+
+	action := dedupeAction{OriginalPath: dup, TargetPath: canonical, Size: 10, ContentHash: "shared-hash"}
+	if err := applyDedupeAction(action, false); err != nil {
+		t.Fatal(err)
+	}
+
+	canonicalInfo, err := os.Stat(filepath.Join(canonical, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupInfo, err := os.Stat(filepath.Join(dup, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(canonicalInfo, dupInfo) {
+		t.Fatal("expected the duplicate's package.json to be hardlinked to the canonical copy after applyDedupeAction")
+	}
+}
+
+func TestRollbackDedupeRestoresIndependentCopy(t *testing.T) {
+	root := t.TempDir()
+	canonical := filepath.Join(root, "canonical")
+	dup := filepath.Join(root, "dup")
+	writeTestPkg(t, canonical, "", 0)
+	writeTestPkg(t, dup, "", 0)
+
+	action := dedupeAction{OriginalPath: dup, TargetPath: canonical, Size: 10, ContentHash: "shared-hash"}
+	if err := applyDedupeAction(action, false); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := dedupeManifest{Actions: []dedupeAction{action}}
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(root, "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rollbackDedupe(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	canonicalInfo, err := os.Stat(filepath.Join(canonical, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupInfo, err := os.Stat(filepath.Join(dup, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(canonicalInfo, dupInfo) {
+		t.Fatal("expected rollback to restore an independent copy, not a hardlink to the canonical copy")
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(dup, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile(filepath.Join(canonical, "package.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(restored) != string(original) {
+		t.Fatalf("expected restored contents to match the canonical copy: %q vs %q", restored, original)
+	}
+}
+
+// TestScanAllConcurrentWorkers exercises the worker pool scanAll spawns
+// across several projects at once (run with -race to catch unsynchronized
+// access to the shared resultStore/scanCache).
+func TestScanAllConcurrentWorkers(t *testing.T) {
+	root := t.TempDir()
+	const numProjects = 8
+	for i := 0; i < numProjects; i++ {
+		proj := filepath.Join(root, fmt.Sprintf("project-%d", i))
+		pkgDir := filepath.Join(proj, "node_modules", "shared-pkg")
+		writeTestPkg(t, pkgDir, "", 0)
+		if err := ioutil.WriteFile(filepath.Join(proj, "package.json"), []byte(`{"name":"proj","version":"1.0.0"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	origWorkers := *workers
+	*workers = 4
+	defer func() { *workers = origWorkers }()
+
+	store, err := scanAll(root, filepath.Join(root, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, ok := store.byID["shared-pkg:1.0.0"]
+	if !ok {
+		t.Fatalf("expected shared-pkg:1.0.0 to be recorded, got %v", store.byID)
+	}
+	if len(infos) != numProjects {
+		t.Fatalf("expected %d instances of shared-pkg across projects, got %d", numProjects, len(infos))
+	}
+}